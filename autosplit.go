@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/grafana/grafana-plugin-model/go/datasource"
+
+	"github.com/niranjan94/grafana-aws-cloudwatch-logs-datasource/cache"
+)
+
+const (
+	// insightsRowCap is the number of rows CloudWatch Logs Insights caps a
+	// single query's results at.
+	insightsRowCap = 10000
+
+	// defaultMaxSplitDepth bounds AutoSplit's recursion when a Target
+	// doesn't set MaxSplitDepth.
+	defaultMaxSplitDepth = 4
+
+	// defaultSplitPollTimeout bounds how long a single AutoSplit sub-query
+	// is polled for when a Target has no MaxWaitDuration.
+	defaultSplitPollTimeout = 5 * time.Minute
+	splitPollInterval       = 1 * time.Second
+
+	startQueryBackoffBase = 500 * time.Millisecond
+	startQueryBackoffMax  = 8 * time.Second
+	startQueryMaxAttempts = 5
+)
+
+// insightsSubRangeStatus reports how one leg of an AutoSplit bisection went,
+// so the panel can show progress even while some sub-ranges are still
+// running.
+type insightsSubRangeStatus struct {
+	Start  int64  `json:"Start"`
+	End    int64  `json:"End"`
+	Status string `json:"Status"`
+	Rows   int    `json:"Rows"`
+}
+
+// startQueryWithBackoff retries StartQuery on LimitExceededException with
+// exponential backoff, fully controlling the wait between attempts itself.
+// The SDK's own default retryer is disabled per-request (MaxRetries: 0) so
+// it doesn't also retry LimitExceededException internally, which would
+// otherwise stack on top of this loop's backoff and multiply both the
+// number of underlying calls and the total wait beyond what
+// startQueryMaxAttempts/startQueryBackoffMax imply - this matters when many
+// AutoSplit legs start queries concurrently and collectively exceed the
+// account's concurrent-query quota.
+func startQueryWithBackoff(ctx context.Context, svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.StartQueryInput) (*cloudwatchlogs.StartQueryOutput, error) {
+	backoff := startQueryBackoffBase
+	var lastErr error
+	for attempt := 0; attempt < startQueryMaxAttempts; attempt++ {
+		req, out := svc.StartQueryRequest(input)
+		req.SetContext(ctx)
+		req.Config.MaxRetries = aws.Int(0)
+		if err := req.Send(); err != nil {
+			lastErr = err
+			if !isLimitExceeded(err) {
+				return nil, err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+			if backoff > startQueryBackoffMax {
+				backoff = startQueryBackoffMax
+			}
+			continue
+		}
+		return out, nil
+	}
+	return nil, lastErr
+}
+
+func isLimitExceeded(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == cloudwatchlogs.ErrCodeLimitExceededException
+}
+
+// pollInsightsQuery polls GetQueryResults until queryId reaches a terminal
+// status or timeout elapses.
+func pollInsightsQuery(ctx context.Context, svc *cloudwatchlogs.CloudWatchLogs, queryId string, timeout time.Duration) (*cloudwatchlogs.GetQueryResultsOutput, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		gresp, err := svc.GetQueryResultsWithContext(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: aws.String(queryId)})
+		if err != nil {
+			return nil, err
+		}
+		switch aws.StringValue(gresp.Status) {
+		case "Complete", "Failed", "Cancelled", "Timeout":
+			return gresp, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("insights sub-query %s timed out after %s", queryId, timeout)
+		}
+		select {
+		case <-time.After(splitPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// runInsightsSubQuery starts one AutoSplit leg and blocks until it completes
+// (or times out), returning its rows and terminal status.
+func runInsightsSubQuery(ctx context.Context, svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.StartQueryInput, timeout time.Duration) ([][]*cloudwatchlogs.ResultField, string, error) {
+	sresp, err := startQueryWithBackoff(ctx, svc, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	gresp, err := pollInsightsQuery(ctx, svc, *sresp.QueryId, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+
+	svc.StopQueryWithContext(ctx, &cloudwatchlogs.StopQueryInput{QueryId: sresp.QueryId})
+
+	status := aws.StringValue(gresp.Status)
+	if status != "Complete" {
+		return nil, status, nil
+	}
+	return gresp.Results, status, nil
+}
+
+// splitInsightsRange runs an Insights query over [start, end) and, if it
+// still hits the row cap, recursively bisects the range and merges the
+// halves, up to maxDepth. sem bounds how many StartQuery calls this
+// AutoSplit run has in flight at once (across every depth), the same way
+// MaxFanoutConcurrency bounds CrossAccountTargets fan-out, since an
+// unbounded 2^depth bisection can otherwise blow through the account's
+// concurrent-query quota on its own.
+func (t *AwsCloudWatchLogsDatasource) splitInsightsRange(ctx context.Context, tsdbReq *datasource.DatasourceRequest, target Target, start, end int64, depth, maxDepth int, timeout time.Duration, sem chan struct{}) ([][]*cloudwatchlogs.ResultField, []insightsSubRangeStatus, error) {
+	sem <- struct{}{}
+	svc, err := t.getClientForDatasource(tsdbReq.Datasource, target.Region)
+	if err != nil {
+		<-sem
+		return nil, nil, err
+	}
+
+	input := target.InputInsightsStartQuery
+	input.StartTime = aws.Int64(start)
+	input.EndTime = aws.Int64(end)
+
+	rows, status, err := runInsightsSubQuery(ctx, svc, &input, timeout)
+	<-sem
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(rows) < insightsRowCap || depth >= maxDepth || end-start < 2 {
+		return rows, []insightsSubRangeStatus{{Start: start, End: end, Status: status, Rows: len(rows)}}, nil
+	}
+
+	mid := start + (end-start)/2
+
+	type halfResult struct {
+		rows     [][]*cloudwatchlogs.ResultField
+		statuses []insightsSubRangeStatus
+		err      error
+	}
+	halves := make([]halfResult, 2)
+	bounds := [2][2]int64{{start, mid}, {mid, end}}
+
+	var wg sync.WaitGroup
+	for i, b := range bounds {
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			rows, statuses, err := t.splitInsightsRange(ctx, tsdbReq, target, start, end, depth+1, maxDepth, timeout, sem)
+			halves[i] = halfResult{rows: rows, statuses: statuses, err: err}
+		}(i, b[0], b[1])
+	}
+	wg.Wait()
+
+	merged := make([][]*cloudwatchlogs.ResultField, 0, len(halves[0].rows)+len(halves[1].rows))
+	statuses := make([]insightsSubRangeStatus, 0)
+	for _, h := range halves {
+		if h.err != nil {
+			return nil, nil, h.err
+		}
+		merged = append(merged, h.rows...)
+		statuses = append(statuses, h.statuses...)
+	}
+
+	return dedupeByPtr(merged), statuses, nil
+}
+
+// autoSplitInsights bisects [start, end) to pick up rows missed by a
+// top-level query that already hit the 10,000-row cap, merging its rows
+// with both halves' and de-duplicating by "@ptr".
+func (t *AwsCloudWatchLogsDatasource) autoSplitInsights(ctx context.Context, tsdbReq *datasource.DatasourceRequest, target Target, start, end int64, topLevelRows [][]*cloudwatchlogs.ResultField, maxWait time.Duration) ([][]*cloudwatchlogs.ResultField, []insightsSubRangeStatus, error) {
+	maxDepth := target.MaxSplitDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxSplitDepth
+	}
+	timeout := maxWait
+	if timeout <= 0 {
+		timeout = defaultSplitPollTimeout
+	}
+	concurrency := target.MaxFanoutConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMaxFanoutConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	mid := start + (end-start)/2
+
+	type halfResult struct {
+		rows     [][]*cloudwatchlogs.ResultField
+		statuses []insightsSubRangeStatus
+		err      error
+	}
+	halves := make([]halfResult, 2)
+	bounds := [2][2]int64{{start, mid}, {mid, end}}
+
+	var wg sync.WaitGroup
+	for i, b := range bounds {
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			rows, statuses, err := t.splitInsightsRange(ctx, tsdbReq, target, start, end, 1, maxDepth, timeout, sem)
+			halves[i] = halfResult{rows: rows, statuses: statuses, err: err}
+		}(i, b[0], b[1])
+	}
+	wg.Wait()
+
+	merged := append([][]*cloudwatchlogs.ResultField{}, topLevelRows...)
+	statuses := []insightsSubRangeStatus{{Start: start, End: end, Status: "Complete", Rows: len(topLevelRows)}}
+	for _, h := range halves {
+		if h.err != nil {
+			return nil, nil, h.err
+		}
+		merged = append(merged, h.rows...)
+		statuses = append(statuses, h.statuses...)
+	}
+
+	deduped := dedupeByPtr(merged)
+	sortRowsByTimestamp(deduped)
+	return deduped, statuses, nil
+}
+
+// fetchInsightsGapsAndMerge runs one blocking Insights query per range in
+// missing (bounded by MaxFanoutConcurrency, the same as AutoSplit's
+// bisection) and merges their rows with the already-cached blobs in
+// cachedBlobs, so a partial-range cache hit only re-scans the gap instead of
+// CloudWatch re-scanning bytes across the whole requested range that were
+// already paid for on a previous query.
+func (t *AwsCloudWatchLogsDatasource) fetchInsightsGapsAndMerge(ctx context.Context, tsdbReq *datasource.DatasourceRequest, target Target, start, end int64, cachedBlobs [][]byte, missing []cache.Range, maxWait time.Duration) ([][]*cloudwatchlogs.ResultField, error) {
+	svc, err := t.getClientForDatasource(tsdbReq.Datasource, target.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := maxWait
+	if timeout <= 0 {
+		timeout = defaultSplitPollTimeout
+	}
+	concurrency := target.MaxFanoutConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMaxFanoutConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	cachedRows, err := unmarshalInsightsBlobs(cachedBlobs)
+	if err != nil {
+		return nil, err
+	}
+	// Cached entries can span a wider range than [start, end) - e.g. one
+	// covering the whole request minus a small gap - so they need clipping
+	// down to what was actually requested; the freshly-fetched gap rows
+	// below are already exact, since AWS applies StartTime/EndTime itself.
+	merged := clipInsightsRowsToRange(cachedRows, start, end)
+
+	gaps := make([][][]*cloudwatchlogs.ResultField, len(missing))
+	errs := make([]error, len(missing))
+	var wg sync.WaitGroup
+	for i, r := range missing {
+		wg.Add(1)
+		go func(i int, r cache.Range) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			input := target.InputInsightsStartQuery
+			input.StartTime = aws.Int64(r.Start)
+			input.EndTime = aws.Int64(r.End)
+
+			rows, status, err := runInsightsSubQuery(ctx, svc, &input, timeout)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if status != "Complete" {
+				errs[i] = fmt.Errorf("insights gap sub-query over [%d,%d) ended with status %s", r.Start, r.End, status)
+				return
+			}
+			gaps[i] = rows
+		}(i, r)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, gaps[i]...)
+	}
+
+	sortRowsByTimestamp(merged)
+	return merged, nil
+}
+
+// insightsRowTimestamp extracts and parses a row's "@timestamp" field, the
+// same layout Insights always formats it in.
+func insightsRowTimestamp(row []*cloudwatchlogs.ResultField) (time.Time, bool) {
+	for _, f := range row {
+		if f.Field != nil && *f.Field == "@timestamp" && f.Value != nil {
+			t, err := time.Parse("2006-01-02 15:04:05.000", *f.Value)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// sortRowsByTimestamp orders rows by their "@timestamp" field so that
+// concatenating the top-level query's rows with its two recursively-split
+// halves doesn't leave a timeserie response jumping backward and forward in
+// time; rows without a parseable "@timestamp" are left in place relative to
+// each other, at the end.
+func sortRowsByTimestamp(rows [][]*cloudwatchlogs.ResultField) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		ti, oki := insightsRowTimestamp(rows[i])
+		tj, okj := insightsRowTimestamp(rows[j])
+		if oki && okj {
+			return ti.Before(tj)
+		}
+		return oki && !okj
+	})
+}
+
+// clipInsightsRowsToRange drops rows whose "@timestamp" falls outside the
+// half-open [start, end) range, in millis. A cache entry can span a wider
+// range than the current request (partial-range reuse stores whatever range
+// it was originally fetched for), so a cache hit must still be clipped down
+// to what was actually asked for rather than handing back everything that
+// happened to be cached alongside it. Rows without a parseable "@timestamp"
+// are kept, since there's no way to tell whether they fall inside the range.
+func clipInsightsRowsToRange(rows [][]*cloudwatchlogs.ResultField, start, end int64) [][]*cloudwatchlogs.ResultField {
+	clipped := make([][]*cloudwatchlogs.ResultField, 0, len(rows))
+	for _, row := range rows {
+		t, ok := insightsRowTimestamp(row)
+		if !ok {
+			clipped = append(clipped, row)
+			continue
+		}
+		ms := t.UnixNano() / int64(time.Millisecond)
+		if ms >= start && ms < end {
+			clipped = append(clipped, row)
+		}
+	}
+	return clipped
+}
+
+// unmarshalInsightsBlobs decodes and concatenates every cached result blob,
+// since a fully-covered cache lookup can be satisfied by more than one
+// overlapping cache entry (e.g. two adjacent ranges cached separately, then
+// a query spanning both).
+func unmarshalInsightsBlobs(blobs [][]byte) ([][]*cloudwatchlogs.ResultField, error) {
+	merged := make([][]*cloudwatchlogs.ResultField, 0)
+	for _, blob := range blobs {
+		var results [][]*cloudwatchlogs.ResultField
+		if err := json.Unmarshal(blob, &results); err != nil {
+			return nil, err
+		}
+		merged = append(merged, results...)
+	}
+	return merged, nil
+}
+
+// dedupeByPtr drops rows whose "@ptr" field (Insights' stable row
+// identifier) has already been seen, since AutoSplit's bisected ranges can
+// overlap a log event that straddles the split point.
+func dedupeByPtr(rows [][]*cloudwatchlogs.ResultField) [][]*cloudwatchlogs.ResultField {
+	seen := make(map[string]bool, len(rows))
+	deduped := make([][]*cloudwatchlogs.ResultField, 0, len(rows))
+	for _, row := range rows {
+		ptr := ""
+		for _, f := range row {
+			if f.Field != nil && *f.Field == "@ptr" && f.Value != nil {
+				ptr = *f.Value
+				break
+			}
+		}
+		if ptr != "" {
+			if seen[ptr] {
+				continue
+			}
+			seen[ptr] = true
+		}
+		deduped = append(deduped, row)
+	}
+	return deduped
+}
@@ -0,0 +1,197 @@
+// Package cache implements a byte-budgeted, TTL-based LRU used to avoid
+// re-issuing AWS calls for time ranges this process has already fetched.
+// CloudWatch Logs Insights bills per byte scanned, so serving overlapping
+// sub-ranges from cache directly reduces cost, not just latency.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Range is a half-open [Start, End) time range. This plugin uses Unix
+// millis throughout, but the type is unit-agnostic.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r Range) size() int64 {
+	if r.End <= r.Start {
+		return 0
+	}
+	return r.End - r.Start
+}
+
+func (r Range) overlaps(o Range) bool {
+	return r.Start < o.End && o.Start < r.End
+}
+
+type entry struct {
+	r         Range
+	data      []byte
+	createdAt time.Time
+}
+
+// LRU caches byte blobs per fingerprint+time-range. Once ByteBudget is
+// exceeded, whole fingerprints are evicted in least-recently-used order;
+// entries older than TTL are treated as misses and lazily dropped.
+type LRU struct {
+	mu         sync.Mutex
+	byteBudget int64
+	ttl        time.Duration
+	usedBytes  int64
+	entries    map[string][]*entry
+	lru        []string // fingerprints, most-recently-used last
+
+	hits   int64
+	misses int64
+}
+
+// Stats returns the cache's cumulative hit/miss counts. Unexported fields
+// backing this are written under mu by Lookup, so callers must go through
+// this accessor rather than reading fields directly to avoid racing with
+// concurrent queries.
+func (c *LRU) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// New creates an LRU bounded by byteBudget bytes of cached data and ttl
+// freshness. byteBudget <= 0 disables eviction (unbounded); ttl <= 0 means
+// entries never expire on their own.
+func New(byteBudget int64, ttl time.Duration) *LRU {
+	return &LRU{
+		byteBudget: byteBudget,
+		ttl:        ttl,
+		entries:    make(map[string][]*entry),
+	}
+}
+
+// Fingerprint hashes the given parts into a cache key. Callers should pass
+// every dimension that changes the query's result set (region, log groups,
+// filter/query string, format, column mapping, ...) but not the time range
+// itself, which is tracked per-entry to support partial-range reuse.
+func Fingerprint(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Lookup returns the live cached blobs overlapping want for fingerprint and
+// the sub-ranges of want not covered by any of them, so the caller only has
+// to fetch the gaps.
+func (c *LRU) Lookup(fingerprint string, want Range) (covered [][]byte, missing []Range) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	live := make([]Range, 0)
+	kept := make([]*entry, 0, len(c.entries[fingerprint]))
+	for _, e := range c.entries[fingerprint] {
+		if c.ttl > 0 && time.Since(e.createdAt) > c.ttl {
+			c.usedBytes -= int64(len(e.data))
+			continue
+		}
+		kept = append(kept, e)
+		if !e.r.overlaps(want) {
+			continue
+		}
+		live = append(live, e.r)
+		covered = append(covered, e.data)
+	}
+	if len(kept) > 0 {
+		c.entries[fingerprint] = kept
+	} else {
+		delete(c.entries, fingerprint)
+	}
+
+	if len(covered) > 0 {
+		c.hits++
+		c.touch(fingerprint)
+	} else {
+		c.misses++
+	}
+
+	return covered, subtract(want, live)
+}
+
+// Put stores a freshly-fetched sub-range for fingerprint, evicting whole
+// fingerprints (oldest-accessed first) until usedBytes is back within
+// byteBudget; fingerprint itself is evicted last, once no other is left.
+func (c *LRU) Put(fingerprint string, r Range, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[fingerprint] = append(c.entries[fingerprint], &entry{r: r, data: data, createdAt: time.Now()})
+	c.usedBytes += int64(len(data))
+	c.touch(fingerprint)
+	c.evict()
+}
+
+func (c *LRU) touch(fingerprint string) {
+	for i, f := range c.lru {
+		if f == fingerprint {
+			c.lru = append(c.lru[:i], c.lru[i+1:]...)
+			break
+		}
+	}
+	c.lru = append(c.lru, fingerprint)
+}
+
+func (c *LRU) evict() {
+	for c.byteBudget > 0 && c.usedBytes > c.byteBudget && len(c.lru) > 0 {
+		victim := c.lru[0]
+		c.lru = c.lru[1:]
+		for _, e := range c.entries[victim] {
+			c.usedBytes -= int64(len(e.data))
+		}
+		delete(c.entries, victim)
+	}
+}
+
+// subtract returns the portions of want not covered by any Range in have.
+func subtract(want Range, have []Range) []Range {
+	if len(have) == 0 {
+		return []Range{want}
+	}
+	sort.Slice(have, func(i, j int) bool { return have[i].Start < have[j].Start })
+
+	gaps := make([]Range, 0)
+	cursor := want.Start
+	for _, h := range have {
+		if cursor >= want.End {
+			break
+		}
+		if h.Start > cursor {
+			gaps = append(gaps, Range{Start: cursor, End: min64(h.Start, want.End)})
+		}
+		if h.End > cursor {
+			cursor = h.End
+		}
+	}
+	if cursor < want.End {
+		gaps = append(gaps, Range{Start: cursor, End: want.End})
+	}
+
+	result := make([]Range, 0, len(gaps))
+	for _, g := range gaps {
+		if g.size() > 0 {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-model/go/datasource"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+
+	"github.com/niranjan94/grafana-aws-cloudwatch-logs-datasource/cache"
+)
+
+const (
+	defaultCacheByteBudget = 64 * 1024 * 1024 // 64MB
+	defaultCacheTTL        = 60 * time.Second
+)
+
+var (
+	resultCachesMu sync.Mutex
+	resultCaches   = map[string]*cache.LRU{}
+)
+
+// cacheForDatasource lazily builds a result cache scoped to one datasource
+// instance (keyed by its OrgId+Id), sized from that instance's own JSON
+// config ("cacheByteBudgetMB", "cacheTTLSeconds"). This legacy NetRPC plugin
+// process serves every instance of this datasource type - potentially
+// different AWS accounts or Grafana orgs - from a single process, so a cache
+// must not be shared across instances: two datasources that happen to query
+// the same region/log group would otherwise transparently serve each
+// other's cached log/Insights data.
+func cacheForDatasource(dsInfo *datasource.DatasourceInfo) *cache.LRU {
+	key := fmt.Sprintf("%d/%d", dsInfo.OrgId, dsInfo.Id)
+
+	resultCachesMu.Lock()
+	defer resultCachesMu.Unlock()
+
+	if c, ok := resultCaches[key]; ok {
+		return c
+	}
+
+	byteBudget := int64(defaultCacheByteBudget)
+	ttl := defaultCacheTTL
+	if jsonData, err := simplejson.NewJson([]byte(dsInfo.JsonData)); err == nil {
+		if mb := jsonData.Get("cacheByteBudgetMB").MustInt(0); mb > 0 {
+			byteBudget = int64(mb) * 1024 * 1024
+		}
+		if secs := jsonData.Get("cacheTTLSeconds").MustInt(0); secs > 0 {
+			ttl = time.Duration(secs) * time.Second
+		}
+	}
+
+	c := cache.New(byteBudget, ttl)
+	resultCaches[key] = c
+	return c
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/grafana/grafana-plugin-model/go/datasource"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+)
+
+// defaultMaxFanoutConcurrency bounds concurrent cross-account/cross-region
+// calls when a Target doesn't set MaxFanoutConcurrency.
+const defaultMaxFanoutConcurrency = 5
+
+// CrossAccountQueryState is round-tripped by the frontend, one entry per
+// CrossAccountTarget, once the fanned-out Insights queries have been started.
+type CrossAccountQueryState struct {
+	Region  string
+	RoleARN string
+	QueryId string
+}
+
+type roleClientCacheKey struct {
+	region  string
+	roleARN string
+}
+
+var (
+	roleClientCacheMu sync.Mutex
+	roleClientCache   = map[roleClientCacheKey]*cloudwatchlogs.CloudWatchLogs{}
+)
+
+// getClientForRole returns a CloudWatchLogs client for region, optionally
+// assuming roleARN (via externalID, when set) first. Role-assumed clients
+// are cached per (region, role) so a dashboard with many panels doesn't
+// re-assume the same role on every query.
+func (t *AwsCloudWatchLogsDatasource) getClientForRole(dsInfo *datasource.DatasourceInfo, region, roleARN, externalID string) (*cloudwatchlogs.CloudWatchLogs, error) {
+	if roleARN == "" {
+		return t.getClient(dsInfo, region)
+	}
+
+	key := roleClientCacheKey{region: region, roleARN: roleARN}
+	roleClientCacheMu.Lock()
+	if svc, ok := roleClientCache[key]; ok {
+		roleClientCacheMu.Unlock()
+		return svc, nil
+	}
+	roleClientCacheMu.Unlock()
+
+	baseSvc, err := t.getClient(dsInfo, region)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(&baseSvc.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+	svc := cloudwatchlogs.New(sess, aws.NewConfig().WithCredentials(creds).WithRegion(region))
+
+	roleClientCacheMu.Lock()
+	roleClientCache[key] = svc
+	roleClientCacheMu.Unlock()
+
+	return svc, nil
+}
+
+// getClientForDatasource returns a CloudWatchLogs client for region, first
+// assuming the datasource-level AssumeRoleARN/ExternalID from its JsonData
+// config when set. This covers a plain, non-fanned-out query, which has no
+// CrossAccountTarget of its own to carry a RoleARN; CrossAccountTargets
+// still assume their own per-leg role via getClientForRole.
+func (t *AwsCloudWatchLogsDatasource) getClientForDatasource(dsInfo *datasource.DatasourceInfo, region string) (*cloudwatchlogs.CloudWatchLogs, error) {
+	roleARN, externalID := datasourceAssumeRoleConfig(dsInfo)
+	return t.getClientForRole(dsInfo, region, roleARN, externalID)
+}
+
+// datasourceAssumeRoleConfig reads the "assumeRoleArn"/"externalId" fields a
+// datasource instance can set in its JsonData config, so a single account
+// can be configured to always assume a role rather than using the
+// credentials getClient resolves by default.
+func datasourceAssumeRoleConfig(dsInfo *datasource.DatasourceInfo) (roleARN string, externalID string) {
+	jsonData, err := simplejson.NewJson([]byte(dsInfo.JsonData))
+	if err != nil {
+		return "", ""
+	}
+	return jsonData.Get("assumeRoleArn").MustString(""), jsonData.Get("externalId").MustString("")
+}
+
+// accountIDFromRoleARN pulls the account ID out of an IAM role ARN, e.g.
+// "arn:aws:iam::123456789012:role/X" -> "123456789012". Returns roleARN
+// unchanged if it isn't a recognizable ARN (e.g. empty, meaning the
+// datasource's own account).
+func accountIDFromRoleARN(roleARN string) string {
+	parts := strings.Split(roleARN, ":")
+	if len(parts) >= 5 && parts[0] == "arn" {
+		return parts[4]
+	}
+	return roleARN
+}
+
+// fanOutLogEvents runs a non-Insights FilterLogEvents query against every
+// CrossAccountTarget concurrently (bounded by MaxFanoutConcurrency) and
+// merges the results into a single table with added "account"/"region"
+// columns. A leg with more than one configured log group is queried once
+// per log group, since FilterLogEvents (unlike StartQuery) takes only a
+// single LogGroupName per call.
+func (t *AwsCloudWatchLogsDatasource) fanOutLogEvents(tsdbReq *datasource.DatasourceRequest, target Target) (*datasource.QueryResult, error) {
+	concurrency := target.MaxFanoutConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMaxFanoutConcurrency
+	}
+	maxEvents := target.MaxEvents
+	if maxEvents <= 0 {
+		maxEvents = defaultMaxEvents
+	}
+
+	type fanResult struct {
+		ct    CrossAccountTarget
+		resps []*cloudwatchlogs.FilterLogEventsOutput
+		err   error
+	}
+
+	results := make([]fanResult, len(target.CrossAccountTargets))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, ct := range target.CrossAccountTargets {
+		wg.Add(1)
+		go func(i int, ct CrossAccountTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			svc, err := t.getClientForRole(tsdbReq.Datasource, ct.Region, ct.RoleARN, ct.ExternalID)
+			if err != nil {
+				results[i] = fanResult{ct: ct, err: err}
+				return
+			}
+
+			// FilterLogEvents only accepts a single LogGroupName per call, so
+			// a leg configured with more than one log group is queried once
+			// per log group and the results merged, the same as
+			// handleInsightsQueryFanout already does via LogGroupNames.
+			logGroups := ct.LogGroups
+			if len(logGroups) == 0 {
+				logGroups = []string{aws.StringValue(target.Input.LogGroupName)}
+			}
+
+			resps := make([]*cloudwatchlogs.FilterLogEventsOutput, 0, len(logGroups))
+			for _, logGroup := range logGroups {
+				input := target.Input
+				input.LogGroupName = aws.String(logGroup)
+
+				resp, err := fetchLogEvents(svc, &input, target.StartFromHead, maxEvents)
+				if err != nil {
+					results[i] = fanResult{ct: ct, err: err}
+					return
+				}
+				resps = append(resps, resp)
+			}
+			results[i] = fanResult{ct: ct, resps: resps}
+		}(i, ct)
+	}
+	wg.Wait()
+
+	table := &datasource.Table{}
+	table.Columns = append(table.Columns,
+		&datasource.TableColumn{Name: "account"},
+		&datasource.TableColumn{Name: "region"},
+		&datasource.TableColumn{Name: "Timestamp"},
+		&datasource.TableColumn{Name: "LogStreamName"},
+		&datasource.TableColumn{Name: "Message"})
+
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		account := accountIDFromRoleARN(r.ct.RoleARN)
+		for _, resp := range r.resps {
+			for _, e := range resp.Events {
+				timestamp := time.Unix(*e.Timestamp/1000, *e.Timestamp%1000*1000*1000).Format(time.RFC3339)
+				row := &datasource.TableRow{}
+				row.Values = append(row.Values,
+					&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: account},
+					&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: r.ct.Region},
+					&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: timestamp},
+					&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: *e.LogStreamName},
+					&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: *e.Message})
+				table.Rows = append(table.Rows, row)
+			}
+		}
+	}
+
+	return &datasource.QueryResult{RefId: target.RefId, Tables: []*datasource.Table{table}}, nil
+}
+
+// handleInsightsQueryFanout mirrors handleInsightsQuery's start/poll
+// round-trip, but drives one StartQuery per CrossAccountTarget and merges
+// completed results into a single table tagged with "account"/"region"
+// columns. CrossAccountQueryIds is round-tripped by the frontend the same
+// way the single-account QueryId is.
+func (t *AwsCloudWatchLogsDatasource) handleInsightsQueryFanout(ctx context.Context, tsdbReq *datasource.DatasourceRequest, target Target) (*datasource.DatasourceResponse, error) {
+	concurrency := target.MaxFanoutConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMaxFanoutConcurrency
+	}
+
+	if len(target.CrossAccountQueryIds) == 0 {
+		type startResult struct {
+			state CrossAccountQueryState
+			err   error
+		}
+
+		results := make([]startResult, len(target.CrossAccountTargets))
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for i, ct := range target.CrossAccountTargets {
+			wg.Add(1)
+			go func(i int, ct CrossAccountTarget) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				svc, err := t.getClientForRole(tsdbReq.Datasource, ct.Region, ct.RoleARN, ct.ExternalID)
+				if err != nil {
+					results[i] = startResult{err: err}
+					return
+				}
+
+				input := target.InputInsightsStartQuery
+				if len(ct.LogGroups) > 0 {
+					input.LogGroupNames = aws.StringSlice(ct.LogGroups)
+					input.LogGroupName = nil
+				}
+
+				req, out := svc.StartQueryRequest(&input)
+				req.SetContext(ctx)
+				req.RetryErrorCodes = append(req.RetryErrorCodes, cloudwatchlogs.ErrCodeLimitExceededException)
+				if err := req.Send(); err != nil {
+					results[i] = startResult{err: err}
+					return
+				}
+				results[i] = startResult{state: CrossAccountQueryState{Region: ct.Region, RoleARN: ct.RoleARN, QueryId: *out.QueryId}}
+			}(i, ct)
+		}
+		wg.Wait()
+
+		states := make([]CrossAccountQueryState, 0, len(results))
+		for _, r := range results {
+			if r.err != nil {
+				return nil, r.err
+			}
+			states = append(states, r.state)
+		}
+
+		metaJson, err := json.Marshal(struct {
+			CrossAccountQueryIds []CrossAccountQueryState
+		}{CrossAccountQueryIds: states})
+		if err != nil {
+			return nil, err
+		}
+		return &datasource.DatasourceResponse{
+			Results: []*datasource.QueryResult{
+				&datasource.QueryResult{RefId: target.RefId, MetaJson: string(metaJson)},
+			},
+		}, nil
+	}
+
+	type pollResult struct {
+		fields []string
+		rows   [][]string
+		status string
+		err    error
+	}
+
+	polled := make([]pollResult, len(target.CrossAccountQueryIds))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, st := range target.CrossAccountQueryIds {
+		wg.Add(1)
+		go func(i int, st CrossAccountQueryState) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			svc, err := t.getClientForRole(tsdbReq.Datasource, st.Region, st.RoleARN, "")
+			if err != nil {
+				polled[i] = pollResult{err: err}
+				return
+			}
+
+			gresp, err := svc.GetQueryResultsWithContext(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: aws.String(st.QueryId)})
+			if err != nil {
+				polled[i] = pollResult{err: err}
+				return
+			}
+			if *gresp.Status != "Complete" {
+				polled[i] = pollResult{status: *gresp.Status}
+				return
+			}
+			svc.StopQueryWithContext(ctx, &cloudwatchlogs.StopQueryInput{QueryId: aws.String(st.QueryId)})
+
+			fields := make([]string, 0)
+			if len(gresp.Results) > 0 {
+				for _, f := range gresp.Results[0] {
+					fields = append(fields, *f.Field)
+				}
+			}
+			rows := make([][]string, 0, len(gresp.Results))
+			for _, r := range gresp.Results {
+				row := make([]string, 0, len(r))
+				for _, f := range r {
+					row = append(row, *f.Value)
+				}
+				rows = append(rows, row)
+			}
+			polled[i] = pollResult{fields: fields, rows: rows, status: "Complete"}
+		}(i, st)
+	}
+	wg.Wait()
+
+	for _, p := range polled {
+		if p.err != nil {
+			return nil, p.err
+		}
+		if p.status != "Complete" {
+			metaJson, err := json.Marshal(map[string]string{"Status": "Running"})
+			if err != nil {
+				return nil, err
+			}
+			return &datasource.DatasourceResponse{
+				Results: []*datasource.QueryResult{
+					&datasource.QueryResult{RefId: target.RefId, MetaJson: string(metaJson)},
+				},
+			}, nil
+		}
+	}
+
+	table := &datasource.Table{}
+	table.Columns = append(table.Columns, &datasource.TableColumn{Name: "account"}, &datasource.TableColumn{Name: "region"})
+	fieldsAdded := false
+	for i, p := range polled {
+		st := target.CrossAccountQueryIds[i]
+		if !fieldsAdded {
+			for _, f := range p.fields {
+				table.Columns = append(table.Columns, &datasource.TableColumn{Name: f})
+			}
+			fieldsAdded = true
+		}
+		account := accountIDFromRoleARN(st.RoleARN)
+		for _, row := range p.rows {
+			tr := &datasource.TableRow{}
+			tr.Values = append(tr.Values,
+				&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: account},
+				&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: st.Region})
+			for _, v := range row {
+				tr.Values = append(tr.Values, &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: v})
+			}
+			table.Rows = append(table.Rows, tr)
+		}
+	}
+
+	return &datasource.DatasourceResponse{
+		Results: []*datasource.QueryResult{
+			&datasource.QueryResult{RefId: target.RefId, Tables: []*datasource.Table{table}},
+		},
+	}, nil
+}
@@ -17,6 +17,8 @@ import (
 	"github.com/grafana/grafana-plugin-model/go/datasource"
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	plugin "github.com/hashicorp/go-plugin"
+
+	"github.com/niranjan94/grafana-aws-cloudwatch-logs-datasource/cache"
 )
 
 type AwsCloudWatchLogsDatasource struct {
@@ -37,6 +39,81 @@ type Target struct {
 	TimestampColumn         string
 	ValueColumn             string
 	StartFromHead           bool
+	// MaxWaitDuration bounds how long an Insights query is allowed to run for,
+	// expressed as a Go duration string (e.g. "2m"). Empty means no limit.
+	MaxWaitDuration string
+	// MaxScannedBytes aborts an in-flight Insights query once CloudWatch
+	// reports it has scanned more than this many bytes. Zero means no limit.
+	MaxScannedBytes int64
+	// StartedAtMs is round-tripped by the frontend alongside QueryId so the
+	// backend can measure elapsed time against MaxWaitDuration on each poll.
+	StartedAtMs int64
+	// LiveTailLogGroupARNs are the log groups tailed by a QueryType: "liveTail"
+	// target. Multiple groups are merged into a single result stream.
+	LiveTailLogGroupARNs []string
+	// LogEventFilterPattern is a CloudWatch Logs filter pattern applied to the
+	// tail, same syntax as Input.FilterPattern.
+	LogEventFilterPattern string
+	// LogStreamNamePrefixes restricts the tail to log streams with any of
+	// these prefixes. Empty means all streams in the log group.
+	LogStreamNamePrefixes []string
+	// LiveTailSeenEventIds is round-tripped by the frontend between polls so
+	// the backend can de-duplicate events across restarts of the tail.
+	LiveTailSeenEventIds []string
+	// LiveTailLastTimestamp is the Unix-millis timestamp of the newest event
+	// already delivered, round-tripped so the next poll only asks CloudWatch
+	// for events after it.
+	LiveTailLastTimestamp int64
+	// CrossAccountTargets, when non-empty, fans this query out across the
+	// listed regions/roles/log groups and merges the results into a single
+	// response with added "account"/"region" columns, instead of using
+	// Region/Input.LogGroupName directly.
+	CrossAccountTargets []CrossAccountTarget
+	// MaxFanoutConcurrency bounds how many CrossAccountTargets are queried at
+	// once. Defaults to defaultMaxFanoutConcurrency when zero.
+	MaxFanoutConcurrency int
+	// CrossAccountQueryIds is round-tripped by the frontend, one entry per
+	// CrossAccountTarget, once the fanned-out Insights queries have been
+	// started. Empty means they still need to be started.
+	CrossAccountQueryIds []CrossAccountQueryState
+	// MessageParser extracts structured fields out of each FilterLogEvents
+	// Message instead of returning it as a single raw string column. One of
+	// "json", "logfmt", "clf", or "regex:<pattern>" (pattern must use named
+	// capture groups, e.g. "regex:(?P<level>\\w+): (?P<duration>\\d+)ms").
+	// Empty means the raw 4-column Timestamp/IngestionTime/LogStreamName/
+	// Message table is returned unchanged.
+	MessageParser string
+	// MaxEvents caps how many events getLogEvent collects for a single
+	// target before it stops paging. Defaults to defaultMaxEvents when zero.
+	MaxEvents int64
+	// AutoSplit, when true, bisects an Insights query's time range and
+	// re-runs each half whenever a result set hits CloudWatch's 10,000-row
+	// cap, recursively, up to MaxSplitDepth.
+	AutoSplit bool
+	// MaxSplitDepth bounds AutoSplit's recursion. Defaults to
+	// defaultMaxSplitDepth when zero.
+	MaxSplitDepth int
+}
+
+// CrossAccountTarget is one leg of a fanned-out query: a region/role/log
+// group combination that is queried concurrently with its siblings and
+// merged into the parent Target's result.
+type CrossAccountTarget struct {
+	Region     string
+	RoleARN    string
+	ExternalID string
+	LogGroups  []string
+}
+
+// insightsQueryMeta is marshaled into QueryResult.MetaJson so the panel can
+// show the query's status and, once available, how much data it scanned.
+type insightsQueryMeta struct {
+	QueryId        string                   `json:"QueryId"`
+	Status         string                   `json:"Status,omitempty"`
+	BytesScanned   *float64                 `json:"BytesScanned,omitempty"`
+	RecordsMatched *float64                 `json:"RecordsMatched,omitempty"`
+	RecordsScanned *float64                 `json:"RecordsScanned,omitempty"`
+	SubRanges      []insightsSubRangeStatus `json:"SubRanges,omitempty"`
 }
 
 var (
@@ -66,6 +143,19 @@ func (t *AwsCloudWatchLogsDatasource) Query(ctx context.Context, tsdbReq *dataso
 		}
 		return response, nil
 	}
+	if modelJson.Get("queryType").MustString() == "liveTail" {
+		response, err := t.handleLiveTailQuery(ctx, tsdbReq, tsdbReq.Queries[0])
+		if err != nil {
+			return &datasource.DatasourceResponse{
+				Results: []*datasource.QueryResult{
+					&datasource.QueryResult{
+						Error: err.Error(),
+					},
+				},
+			}, nil
+		}
+		return response, nil
+	}
 	if modelJson.Get("queryType").MustString() == "annotationQuery" {
 		target := Target{}
 		if err := json.Unmarshal([]byte(tsdbReq.Queries[0].ModelJson), &target); err != nil {
@@ -82,7 +172,7 @@ func (t *AwsCloudWatchLogsDatasource) Query(ctx context.Context, tsdbReq *dataso
 		target.Input.StartTime = aws.Int64(fromRaw)
 		target.Input.EndTime = aws.Int64(toRaw)
 
-		resp, err := t.getLogEvent(tsdbReq, target.Region, &target.Input, true)
+		resp, _, err := t.getLogEvent(tsdbReq, target.Region, &target.Input, true, target.MaxEvents)
 		if err != nil {
 			return nil, err
 		}
@@ -125,7 +215,7 @@ func (t *AwsCloudWatchLogsDatasource) Query(ctx context.Context, tsdbReq *dataso
 		if len(tsdbReq.Queries) != 1 {
 			return nil, fmt.Errorf("invalid insights query, it should be single")
 		}
-		response, err := t.handleInsightsQuery(tsdbReq, tsdbReq.Queries[0])
+		response, err := t.handleInsightsQuery(ctx, tsdbReq, tsdbReq.Queries[0])
 		if err != nil {
 			return &datasource.DatasourceResponse{
 				Results: []*datasource.QueryResult{
@@ -161,17 +251,39 @@ func (t *AwsCloudWatchLogsDatasource) handleQuery(tsdbReq *datasource.Datasource
 		targets = append(targets, target)
 	}
 
+	var cacheHits, cacheMisses int64
 	for _, target := range targets {
-		resp, err := t.getLogEvent(tsdbReq, target.Region, &target.Input, target.StartFromHead)
+		if len(target.CrossAccountTargets) > 0 {
+			r, err := t.fanOutLogEvents(tsdbReq, target)
+			if err != nil {
+				return nil, err
+			}
+			response.Results = append(response.Results, r)
+			continue
+		}
+
+		resp, cacheHit, err := t.getLogEvent(tsdbReq, target.Region, &target.Input, target.StartFromHead, target.MaxEvents)
 		if err != nil {
 			return nil, err
 		}
+		if cacheHit {
+			cacheHits++
+		} else {
+			cacheMisses++
+		}
 
 		switch target.Format {
 		case "timeserie":
-			return nil, fmt.Errorf("not supported")
+			if target.MessageParser == "" || target.ValueColumn == "" {
+				return nil, fmt.Errorf("timeserie format requires MessageParser and ValueColumn")
+			}
+			r, err := parseTimeSeriesResponse(resp, target)
+			if err != nil {
+				return nil, err
+			}
+			response.Results = append(response.Results, r)
 		case "table":
-			r, err := parseTableResponse(resp, target.RefId)
+			r, err := parseTableResponse(resp, target.RefId, target.MessageParser)
 			if err != nil {
 				return nil, err
 			}
@@ -179,10 +291,25 @@ func (t *AwsCloudWatchLogsDatasource) handleQuery(tsdbReq *datasource.Datasource
 		}
 	}
 
+	if len(response.Results) > 0 {
+		if metaJson, err := json.Marshal(cacheStats{CacheHits: cacheHits, CacheMisses: cacheMisses}); err == nil {
+			response.Results[len(response.Results)-1].MetaJson = string(metaJson)
+		}
+	}
+
 	return response, nil
 }
 
-func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.DatasourceRequest, query *datasource.Query) (*datasource.DatasourceResponse, error) {
+// cacheStats is marshaled into a QueryResult's MetaJson so the panel can
+// show how much of this request was served from the result cache instead of
+// AWS, which matters because Insights bills per byte scanned. The counts are
+// scoped to this call's own targets, not the cache's process-lifetime totals.
+type cacheStats struct {
+	CacheHits   int64 `json:"CacheHits"`
+	CacheMisses int64 `json:"CacheMisses"`
+}
+
+func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(ctx context.Context, tsdbReq *datasource.DatasourceRequest, query *datasource.Query) (*datasource.DatasourceResponse, error) {
 	response := &datasource.DatasourceResponse{}
 
 	fromRaw, err := strconv.ParseInt(tsdbReq.TimeRange.FromRaw, 10, 64)
@@ -200,7 +327,56 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 	target.InputInsightsStartQuery.StartTime = aws.Int64(fromRaw)
 	target.InputInsightsStartQuery.EndTime = aws.Int64(toRaw)
 
-	svc, err := t.getClient(tsdbReq.Datasource, target.Region)
+	if len(target.CrossAccountTargets) > 0 {
+		return t.handleInsightsQueryFanout(ctx, tsdbReq, target)
+	}
+
+	resultCache := cacheForDatasource(tsdbReq.Datasource)
+	// AutoSplit/MaxSplitDepth are part of the fingerprint because a result
+	// cached from a capped, non-AutoSplit run is truncated at insightsRowCap:
+	// serving it back once AutoSplit is turned on would silently skip
+	// autoSplitInsights and keep returning the stale, incomplete rows.
+	fingerprint := cache.Fingerprint("insights", target.Region,
+		strings.Join(aws.StringValueSlice(target.InputInsightsStartQuery.LogGroupNames), ","),
+		aws.StringValue(target.InputInsightsStartQuery.LogGroupName),
+		aws.StringValue(target.InputInsightsStartQuery.QueryString),
+		target.Format, target.TimestampColumn, target.ValueColumn,
+		strconv.FormatBool(target.AutoSplit), strconv.Itoa(target.MaxSplitDepth))
+
+	var maxWait time.Duration
+	if target.MaxWaitDuration != "" {
+		maxWait, err = time.ParseDuration(target.MaxWaitDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MaxWaitDuration: %s", err)
+		}
+	}
+
+	if target.QueryId == "" {
+		cachedBlobs, missing := resultCache.Lookup(fingerprint, cache.Range{Start: fromRaw, End: toRaw})
+		if len(cachedBlobs) > 0 && len(missing) == 0 {
+			if results, err := unmarshalInsightsBlobs(cachedBlobs); err == nil {
+				meta := insightsQueryMeta{QueryId: "cached", Status: "Complete"}
+				return buildInsightsResultResponse(target, clipInsightsRowsToRange(results, fromRaw, toRaw), meta, response)
+			}
+		} else if len(cachedBlobs) > 0 {
+			// Partial overlap: fetch only the missing sub-ranges, blocking on
+			// the same StartQuery+poll helpers AutoSplit uses, instead of
+			// re-running the whole range - the overlapping portion already
+			// had its bytes scanned and paid for.
+			if merged, err := t.fetchInsightsGapsAndMerge(ctx, tsdbReq, target, fromRaw, toRaw, cachedBlobs, missing, maxWait); err == nil {
+				meta := insightsQueryMeta{QueryId: "cached", Status: "Complete"}
+				if cacheEntry, err := json.Marshal(merged); err == nil {
+					resultCache.Put(fingerprint, cache.Range{Start: fromRaw, End: toRaw}, cacheEntry)
+				}
+				return buildInsightsResultResponse(target, merged, meta, response)
+			}
+			// Gap-fill failed (e.g. a sub-query errored or timed out): fall
+			// through to the normal async start/poll path below instead of
+			// failing the whole query.
+		}
+	}
+
+	svc, err := t.getClientForDatasource(tsdbReq.Datasource, target.Region)
 	if err != nil {
 		return nil, err
 	}
@@ -208,13 +384,14 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 	// start query
 	if target.QueryId == "" {
 		req, out := svc.StartQueryRequest(&target.InputInsightsStartQuery)
+		req.SetContext(ctx)
 		req.RetryErrorCodes = append(req.RetryErrorCodes, cloudwatchlogs.ErrCodeLimitExceededException)
 		sresp, err := out, req.Send()
 		if err != nil {
 			return nil, err
 		}
 
-		queryIdJson, err := json.Marshal(map[string]string{"QueryId": *sresp.QueryId})
+		queryIdJson, err := json.Marshal(insightsQueryMeta{QueryId: *sresp.QueryId})
 		if err != nil {
 			return nil, err
 		}
@@ -228,26 +405,42 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 		}, nil
 	}
 
-	var dresp *cloudwatchlogs.DescribeQueriesOutput
-	if target.InputInsightsStartQuery.LogGroupNames != nil {
-		dresp, err = svc.DescribeQueries(&cloudwatchlogs.DescribeQueriesInput{LogGroupName: target.InputInsightsStartQuery.LogGroupNames[0]})
-	} else {
-		dresp, err = svc.DescribeQueries(&cloudwatchlogs.DescribeQueriesInput{LogGroupName: target.InputInsightsStartQuery.LogGroupName})
+	if maxWait > 0 && target.StartedAtMs > 0 {
+		startedAt := time.Unix(0, target.StartedAtMs*int64(time.Millisecond))
+		if time.Since(startedAt) > maxWait {
+			svc.StopQueryWithContext(ctx, &cloudwatchlogs.StopQueryInput{QueryId: aws.String(target.QueryId)})
+			return nil, fmt.Errorf("insights query %s exceeded MaxWaitDuration of %s and was stopped", target.QueryId, maxWait)
+		}
 	}
-	if err != nil {
+
+	if err := ctx.Err(); err != nil {
+		svc.StopQueryWithContext(context.Background(), &cloudwatchlogs.StopQueryInput{QueryId: aws.String(target.QueryId)})
 		return nil, err
 	}
-	queryIndex := -1
-	for i, query := range dresp.Queries {
-		if *query.QueryId == target.QueryId {
-			queryIndex = i
-		}
+
+	// GetQueryResults reports Statistics.BytesScanned while the query is
+	// still Running, not just once it reaches Complete, so MaxScannedBytes
+	// is checked on every poll - the same way MaxWaitDuration is checked
+	// above regardless of completion - rather than only after the query has
+	// already finished and AWS has already billed for every byte scanned,
+	// at which point StopQuery can no longer abort anything.
+	gresp, err := svc.GetQueryResultsWithContext(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: aws.String(target.QueryId)})
+	if err != nil {
+		return nil, err
 	}
-	if queryIndex == -1 {
-		return nil, fmt.Errorf("%s is not found", target.QueryId)
+
+	if target.MaxScannedBytes > 0 && gresp.Statistics != nil && gresp.Statistics.BytesScanned != nil &&
+		int64(*gresp.Statistics.BytesScanned) > target.MaxScannedBytes {
+		svc.StopQueryWithContext(ctx, &cloudwatchlogs.StopQueryInput{QueryId: aws.String(target.QueryId)})
+		return nil, fmt.Errorf("insights query %s exceeded MaxScannedBytes of %d and was stopped", target.QueryId, target.MaxScannedBytes)
 	}
-	if *dresp.Queries[queryIndex].Status != "Complete" {
-		queryIdJson, err := json.Marshal(map[string]string{"QueryId": target.QueryId, "Status": *dresp.Queries[queryIndex].Status})
+
+	if aws.StringValue(gresp.Status) != "Complete" {
+		meta := insightsQueryMeta{QueryId: target.QueryId, Status: aws.StringValue(gresp.Status)}
+		if gresp.Statistics != nil {
+			meta.BytesScanned = gresp.Statistics.BytesScanned
+		}
+		queryIdJson, err := json.Marshal(meta)
 		if err != nil {
 			return nil, err
 		}
@@ -261,24 +454,44 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 		}, nil
 	}
 
-	gresp, err := svc.GetQueryResults(&cloudwatchlogs.GetQueryResultsInput{QueryId: aws.String(target.QueryId)})
+	_, err = svc.StopQuery(&cloudwatchlogs.StopQueryInput{QueryId: aws.String(target.QueryId)})
 	if err != nil {
-		return nil, err
+		// ignore error
+	}
+
+	meta := insightsQueryMeta{QueryId: target.QueryId, Status: *gresp.Status}
+	if gresp.Statistics != nil {
+		meta.BytesScanned = gresp.Statistics.BytesScanned
+		meta.RecordsMatched = gresp.Statistics.RecordsMatched
+		meta.RecordsScanned = gresp.Statistics.RecordsScanned
 	}
-	if *gresp.Status != "Complete" {
-		return nil, fmt.Errorf("unexpected status")
+
+	if target.AutoSplit && len(gresp.Results) >= insightsRowCap {
+		merged, subRanges, err := t.autoSplitInsights(ctx, tsdbReq, target, fromRaw, toRaw, gresp.Results, maxWait)
+		if err != nil {
+			return nil, err
+		}
+		gresp.Results = merged
+		meta.SubRanges = subRanges
 	}
 
-	_, err = svc.StopQuery(&cloudwatchlogs.StopQueryInput{QueryId: aws.String(target.QueryId)})
-	if err != nil {
-		// ignore error
+	if cacheEntry, err := json.Marshal(gresp.Results); err == nil {
+		resultCache.Put(fingerprint, cache.Range{Start: fromRaw, End: toRaw}, cacheEntry)
 	}
 
-	queryIdJson, err := json.Marshal(map[string]string{"QueryId": target.QueryId, "Status": *gresp.Status})
+	return buildInsightsResultResponse(target, gresp.Results, meta, response)
+}
+
+// buildInsightsResultResponse turns a completed Insights query's rows into a
+// timeserie or table DatasourceResponse. It's shared by the live-fetch path
+// above and the result cache's hit path, which skips straight to here with
+// previously-fetched rows instead of calling DescribeQueries/GetQueryResults.
+func buildInsightsResultResponse(target Target, results [][]*cloudwatchlogs.ResultField, meta insightsQueryMeta, response *datasource.DatasourceResponse) (*datasource.DatasourceResponse, error) {
+	queryIdJson, err := json.Marshal(meta)
 	if err != nil {
 		return nil, err
 	}
-	if len(gresp.Results) == 0 {
+	if len(results) == 0 {
 		return &datasource.DatasourceResponse{
 			Results: []*datasource.QueryResult{
 				&datasource.QueryResult{
@@ -292,7 +505,7 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 	if target.Format == "timeserie" {
 		series := make(map[string]*datasource.TimeSeries)
 
-		for _, r := range gresp.Results {
+		for _, r := range results {
 			var t time.Time
 			var timestamp int64
 			var value float64
@@ -344,10 +557,10 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 		})
 	} else {
 		table := &datasource.Table{}
-		for _, f := range gresp.Results[0] {
+		for _, f := range results[0] {
 			table.Columns = append(table.Columns, &datasource.TableColumn{Name: *f.Field})
 		}
-		for _, r := range gresp.Results {
+		for _, r := range results {
 			row := &datasource.TableRow{}
 			for _, f := range r {
 				row.Values = append(row.Values, &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: *f.Value})
@@ -365,18 +578,86 @@ func (t *AwsCloudWatchLogsDatasource) handleInsightsQuery(tsdbReq *datasource.Da
 	return response, nil
 }
 
-func (t *AwsCloudWatchLogsDatasource) getLogEvent(tsdbReq *datasource.DatasourceRequest, region string, input *cloudwatchlogs.FilterLogEventsInput, startFromHead bool) (*cloudwatchlogs.FilterLogEventsOutput, error) {
-	svc, err := t.getClient(tsdbReq.Datasource, region)
+// defaultMaxEvents is the fallback per-target event cap for getLogEvent when
+// a Target doesn't set MaxEvents. It matches the limit this plugin always
+// enforced before MaxEvents became configurable.
+const defaultMaxEvents = 10000
+
+// getLogEvent fetches FilterLogEvents/GetLogEvents for the requested range,
+// reusing the result cache for any sub-range it already has. The returned
+// bool reports whether any part of the range was served from cache, for the
+// caller to report per-call (not process-lifetime) cache stats.
+func (t *AwsCloudWatchLogsDatasource) getLogEvent(tsdbReq *datasource.DatasourceRequest, region string, input *cloudwatchlogs.FilterLogEventsInput, startFromHead bool, maxEvents int64) (*cloudwatchlogs.FilterLogEventsOutput, bool, error) {
+	if maxEvents <= 0 {
+		maxEvents = defaultMaxEvents
+	}
+
+	svc, err := t.getClientForDatasource(tsdbReq.Datasource, region)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
+	resultCache := cacheForDatasource(tsdbReq.Datasource)
+	fingerprint := cache.Fingerprint(region, aws.StringValue(input.LogGroupName), aws.StringValue(input.FilterPattern),
+		strings.Join(aws.StringValueSlice(input.LogStreamNames), ","), strconv.FormatBool(startFromHead))
+	want := cache.Range{Start: *input.StartTime, End: *input.EndTime}
+
+	cachedBlobs, missing := resultCache.Lookup(fingerprint, want)
+	cacheHit := len(cachedBlobs) > 0
+
 	resp := &cloudwatchlogs.FilterLogEventsOutput{}
+	for _, blob := range cachedBlobs {
+		var events []*cloudwatchlogs.FilteredLogEvent
+		if err := json.Unmarshal(blob, &events); err != nil {
+			return nil, false, err
+		}
+		// A cache entry can span a wider range than want (partial-range
+		// reuse stores whatever range it was originally fetched for), so
+		// events from it must be clipped down to what was actually
+		// requested rather than handed back wholesale.
+		for _, e := range events {
+			if *e.Timestamp >= want.Start && *e.Timestamp < want.End {
+				resp.Events = append(resp.Events, e)
+			}
+		}
+	}
+
+	for _, r := range missing {
+		subInput := *input
+		subInput.StartTime = aws.Int64(r.Start)
+		subInput.EndTime = aws.Int64(r.End)
+
+		fetched, err := fetchLogEvents(svc, &subInput, startFromHead, maxEvents)
+		if err != nil {
+			return nil, false, err
+		}
+		resp.Events = append(resp.Events, fetched.Events...)
+
+		if blob, err := json.Marshal(fetched.Events); err == nil {
+			resultCache.Put(fingerprint, r, blob)
+		}
+	}
+
+	sort.Slice(resp.Events, func(i, j int) bool {
+		return *resp.Events[i].Timestamp < *resp.Events[j].Timestamp
+	})
+
+	return resp, cacheHit, nil
+}
+
+// fetchLogEvents issues the actual FilterLogEvents/GetLogEvents calls for a
+// single time range. Split out of getLogEvent so the cache's partial-range
+// reuse can call it once per missing sub-range instead of always fetching
+// the whole requested window. maxEvents replaces the plugin's previous
+// hard-coded 10000-event safety limit.
+func fetchLogEvents(svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.FilterLogEventsInput, startFromHead bool, maxEvents int64) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	resp := &cloudwatchlogs.FilterLogEventsOutput{}
+	var err error
 	if *input.FilterPattern != "" || len(input.LogStreamNames) != 1 {
 		err = svc.FilterLogEventsPages(input,
 			func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
 				resp.Events = append(resp.Events, page.Events...)
-				if len(resp.Events) > 10000 {
+				if int64(len(resp.Events)) > maxEvents {
 					return false // safety limit
 				}
 				if int64(len(resp.Events)) >= *input.Limit {
@@ -404,7 +685,7 @@ func (t *AwsCloudWatchLogsDatasource) getLogEvent(tsdbReq *datasource.Datasource
 					}
 					resp.Events = append(resp.Events, fe)
 				}
-				if len(resp.Events) > 10000 {
+				if int64(len(resp.Events)) > maxEvents {
 					return false // safety limit
 				}
 				if int64(len(resp.Events)) >= *input.Limit {
@@ -420,7 +701,11 @@ func (t *AwsCloudWatchLogsDatasource) getLogEvent(tsdbReq *datasource.Datasource
 	return resp, nil
 }
 
-func parseTableResponse(resp *cloudwatchlogs.FilterLogEventsOutput, refId string) (*datasource.QueryResult, error) {
+func parseTableResponse(resp *cloudwatchlogs.FilterLogEventsOutput, refId string, messageParser string) (*datasource.QueryResult, error) {
+	if messageParser != "" {
+		return parseStructuredTableResponse(resp, refId, messageParser)
+	}
+
 	table := &datasource.Table{}
 
 	table.Columns = append(table.Columns, &datasource.TableColumn{Name: "Timestamp"})
@@ -474,7 +759,7 @@ type suggestData struct {
 
 func (t *AwsCloudWatchLogsDatasource) metricFindQuery(ctx context.Context, tsdbReq *datasource.DatasourceRequest, parameters *simplejson.Json) (*datasource.DatasourceResponse, error) {
 	region := parameters.Get("region").MustString()
-	svc, err := t.getClient(tsdbReq.Datasource, region)
+	svc, err := t.getClientForDatasource(tsdbReq.Datasource, region)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/grafana/grafana-plugin-model/go/datasource"
+)
+
+// maxLiveTailSeenEventIds bounds how many event IDs are round-tripped between
+// polls so the de-duplication set doesn't grow without limit over a long tail.
+const maxLiveTailSeenEventIds = 2000
+
+// liveTailMeta is round-tripped via MetaJson/the frontend so the next poll
+// can resume exactly where this one left off.
+type liveTailMeta struct {
+	LastTimestamp int64    `json:"LiveTailLastTimestamp"`
+	SeenEventIds  []string `json:"LiveTailSeenEventIds"`
+}
+
+// handleLiveTailQuery implements QueryType: "liveTail". This is a polling
+// fallback, not a real tail: this plugin is still on the legacy NetRPC
+// grafana-plugin-model backend, which predates both
+// cloudwatchlogs.StartLiveTail and grafana-plugin-sdk-go's backend streaming
+// channel, so there is no code path here toward pushing events to the panel
+// as they arrive. Instead, the frontend re-issues this query on an interval
+// and we only ask CloudWatch for events newer than LiveTailLastTimestamp,
+// de-duplicating against LiveTailSeenEventIds in case CloudWatch returns an
+// event again at the second-resolution boundary. Migrating to
+// grafana-plugin-sdk-go's stream handler to get genuine push-based tailing
+// is tracked as a follow-up, not done here.
+func (t *AwsCloudWatchLogsDatasource) handleLiveTailQuery(ctx context.Context, tsdbReq *datasource.DatasourceRequest, query *datasource.Query) (*datasource.DatasourceResponse, error) {
+	target := Target{}
+	if err := json.Unmarshal([]byte(query.ModelJson), &target); err != nil {
+		return nil, err
+	}
+
+	fromRaw, err := strconv.ParseInt(tsdbReq.TimeRange.FromRaw, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	toRaw, err := strconv.ParseInt(tsdbReq.TimeRange.ToRaw, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := fromRaw
+	if target.LiveTailLastTimestamp > startTime {
+		startTime = target.LiveTailLastTimestamp + 1
+	}
+
+	seen := make(map[string]bool, len(target.LiveTailSeenEventIds))
+	seenOrder := make([]string, 0, len(target.LiveTailSeenEventIds))
+	for _, id := range target.LiveTailSeenEventIds {
+		if !seen[id] {
+			seen[id] = true
+			seenOrder = append(seenOrder, id)
+		}
+	}
+
+	svc, err := t.getClientForDatasource(tsdbReq.Datasource, target.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	logGroupNames := make([]string, 0, len(target.LiveTailLogGroupARNs))
+	for _, arn := range target.LiveTailLogGroupARNs {
+		logGroupNames = append(logGroupNames, logGroupNameFromARN(arn))
+	}
+
+	// FilterLogEventsInput only accepts a single LogStreamNamePrefix, so
+	// multiple configured prefixes are covered with one call each and merged
+	// here; the de-duplication below already handles prefixes that overlap.
+	prefixes := target.LogStreamNamePrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	events := make([]*cloudwatchlogs.FilteredLogEvent, 0)
+	for _, logGroupName := range logGroupNames {
+		for _, prefix := range prefixes {
+			input := &cloudwatchlogs.FilterLogEventsInput{
+				LogGroupName: aws.String(logGroupName),
+				StartTime:    aws.Int64(startTime),
+				EndTime:      aws.Int64(toRaw),
+			}
+			if target.LogEventFilterPattern != "" {
+				input.FilterPattern = aws.String(target.LogEventFilterPattern)
+			}
+			if prefix != "" {
+				input.LogStreamNamePrefix = aws.String(prefix)
+			}
+
+			err = svc.FilterLogEventsPagesWithContext(ctx, input,
+				func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+					events = append(events, page.Events...)
+					return !lastPage
+				})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	newEvents := make([]*cloudwatchlogs.FilteredLogEvent, 0, len(events))
+	lastTimestamp := target.LiveTailLastTimestamp
+	for _, e := range events {
+		if e.EventId != nil && seen[*e.EventId] {
+			continue
+		}
+		newEvents = append(newEvents, e)
+		if e.EventId != nil {
+			seen[*e.EventId] = true
+			seenOrder = append(seenOrder, *e.EventId)
+		}
+		if e.Timestamp != nil && *e.Timestamp > lastTimestamp {
+			lastTimestamp = *e.Timestamp
+		}
+	}
+
+	table := &datasource.Table{}
+	table.Columns = append(table.Columns, &datasource.TableColumn{Name: "Timestamp"})
+	table.Columns = append(table.Columns, &datasource.TableColumn{Name: "LogStreamName"})
+	table.Columns = append(table.Columns, &datasource.TableColumn{Name: "Message"})
+	for _, e := range newEvents {
+		row := &datasource.TableRow{}
+		timestamp := time.Unix(*e.Timestamp/1000, *e.Timestamp%1000*1000*1000).Format(time.RFC3339)
+		row.Values = append(row.Values, &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: timestamp})
+		row.Values = append(row.Values, &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: *e.LogStreamName})
+		row.Values = append(row.Values, &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: *e.Message})
+		table.Rows = append(table.Rows, row)
+	}
+
+	meta := liveTailMeta{LastTimestamp: lastTimestamp, SeenEventIds: capLiveTailSeenEventIds(seenOrder)}
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &datasource.DatasourceResponse{
+		Results: []*datasource.QueryResult{
+			&datasource.QueryResult{
+				RefId:    target.RefId,
+				Tables:   []*datasource.Table{table},
+				MetaJson: string(metaJson),
+			},
+		},
+	}, nil
+}
+
+// capLiveTailSeenEventIds bounds the round-tripped de-duplication set to the
+// most recent maxLiveTailSeenEventIds entries of ids, which is ordered
+// oldest-seen first.
+func capLiveTailSeenEventIds(ids []string) []string {
+	if len(ids) > maxLiveTailSeenEventIds {
+		ids = ids[len(ids)-maxLiveTailSeenEventIds:]
+	}
+	return ids
+}
+
+// logGroupNameFromARN extracts the log group name from a CloudWatch Logs log
+// group ARN, e.g. "arn:aws:logs:us-east-1:1234:log-group:/my/group" ->
+// "/my/group". ARNs without a "log-group:" segment are returned unchanged,
+// allowing plain log group names to be used as well.
+func logGroupNameFromARN(arn string) string {
+	const marker = "log-group:"
+	if idx := strings.Index(arn, marker); idx != -1 {
+		name := arn[idx+len(marker):]
+		return strings.TrimSuffix(name, ":*")
+	}
+	return arn
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+
+	"github.com/grafana/grafana-plugin-model/go/datasource"
+)
+
+// clfPattern matches an Apache/nginx Common Log Format line:
+// host ident authuser [timestamp] "request" status bytes
+var clfPattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\S+)`)
+var clfFields = []string{"RemoteHost", "Ident", "AuthUser", "Timestamp", "Request", "Status", "BytesSent"}
+
+// logfmtPattern matches one key=value pair, where value is either a bare
+// token or a double-quoted string.
+var logfmtPattern = regexp.MustCompile(`(\w+)=("(?:[^"\\]|\\.)*"|\S+)`)
+
+// regexParserCache memoizes compiled "regex:<pattern>" MessageParsers by
+// pattern string, so a query that parses thousands of events in a loop only
+// pays regexp.Compile once instead of once per event.
+var (
+	regexParserCacheMu sync.Mutex
+	regexParserCache   = map[string]*regexp.Regexp{}
+)
+
+// compileRegexParser returns a cached *regexp.Regexp for pattern, compiling
+// and caching it on first use.
+func compileRegexParser(pattern string) (*regexp.Regexp, error) {
+	regexParserCacheMu.Lock()
+	if re, ok := regexParserCache[pattern]; ok {
+		regexParserCacheMu.Unlock()
+		return re, nil
+	}
+	regexParserCacheMu.Unlock()
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexParserCacheMu.Lock()
+	regexParserCache[pattern] = re
+	regexParserCacheMu.Unlock()
+	return re, nil
+}
+
+// parseMessage extracts a field name -> value map out of a log message
+// according to parser, one of "json", "logfmt", "clf", or
+// "regex:<pattern>". Values are typed (float64, bool, or string) so callers
+// can infer a RowValue kind from them.
+func parseMessage(parser string, message string) (map[string]interface{}, error) {
+	switch {
+	case parser == "json":
+		return parseJSONMessage(message)
+	case parser == "logfmt":
+		return parseLogfmtMessage(message), nil
+	case parser == "clf":
+		return parseCLFMessage(message), nil
+	case strings.HasPrefix(parser, "regex:"):
+		return parseRegexMessage(strings.TrimPrefix(parser, "regex:"), message)
+	default:
+		return nil, fmt.Errorf("unsupported MessageParser: %s", parser)
+	}
+}
+
+func parseJSONMessage(message string) (map[string]interface{}, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(message), &raw); err != nil {
+		// A message that isn't valid JSON (a stack trace, a startup banner,
+		// ...) just contributes no fields, the same way parseLogfmtMessage,
+		// parseCLFMessage and parseRegexMessage degrade on a non-match,
+		// rather than failing the whole query over one odd line.
+		return map[string]interface{}{}, nil
+	}
+	fields := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		switch vv := v.(type) {
+		case float64, bool, string:
+			fields[k] = vv
+		default:
+			b, _ := json.Marshal(vv)
+			fields[k] = string(b)
+		}
+	}
+	return fields, nil
+}
+
+func parseLogfmtMessage(message string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, m := range logfmtPattern.FindAllStringSubmatch(message, -1) {
+		fields[m[1]] = inferScalar(strings.Trim(m[2], `"`))
+	}
+	return fields
+}
+
+func parseCLFMessage(message string) map[string]interface{} {
+	m := clfPattern.FindStringSubmatch(message)
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	fields := make(map[string]interface{}, len(clfFields))
+	for i, name := range clfFields {
+		fields[name] = inferScalar(m[i+1])
+	}
+	return fields
+}
+
+func parseRegexMessage(pattern string, message string) (map[string]interface{}, error) {
+	re, err := compileRegexParser(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MessageParser regex: %s", err)
+	}
+	m := re.FindStringSubmatch(message)
+	if m == nil {
+		return map[string]interface{}{}, nil
+	}
+	fields := make(map[string]interface{}, len(m))
+	for i, name := range re.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		fields[name] = inferScalar(m[i])
+	}
+	return fields, nil
+}
+
+// inferScalar converts a captured string into a float64 or bool when it
+// unambiguously looks like one, otherwise leaves it as a string.
+func inferScalar(s string) interface{} {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return s
+}
+
+// rowValueForScalar builds a typed RowValue out of a value produced by
+// parseMessage, defaulting to an empty string for fields missing from a
+// given event.
+func rowValueForScalar(v interface{}) *datasource.RowValue {
+	switch vv := v.(type) {
+	case float64:
+		return &datasource.RowValue{Kind: datasource.RowValue_TYPE_DOUBLE, DoubleValue: vv}
+	case bool:
+		return &datasource.RowValue{Kind: datasource.RowValue_TYPE_BOOL, BoolValue: vv}
+	case string:
+		return &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: vv}
+	default:
+		return &datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: ""}
+	}
+}
+
+// parseStructuredTableResponse parses every event's Message with
+// messageParser and unions the discovered field names into table columns,
+// in addition to the Timestamp/IngestionTime/LogStreamName columns the raw
+// table always carries.
+func parseStructuredTableResponse(resp *cloudwatchlogs.FilterLogEventsOutput, refId string, messageParser string) (*datasource.QueryResult, error) {
+	parsedEvents := make([]map[string]interface{}, len(resp.Events))
+	fieldOrder := make([]string, 0)
+	seenField := make(map[string]bool)
+	for i, e := range resp.Events {
+		fields, err := parseMessage(messageParser, *e.Message)
+		if err != nil {
+			return nil, err
+		}
+		parsedEvents[i] = fields
+		for name := range fields {
+			if !seenField[name] {
+				seenField[name] = true
+				fieldOrder = append(fieldOrder, name)
+			}
+		}
+	}
+
+	table := &datasource.Table{}
+	table.Columns = append(table.Columns,
+		&datasource.TableColumn{Name: "Timestamp"},
+		&datasource.TableColumn{Name: "IngestionTime"},
+		&datasource.TableColumn{Name: "LogStreamName"})
+	for _, name := range fieldOrder {
+		table.Columns = append(table.Columns, &datasource.TableColumn{Name: name})
+	}
+
+	for i, e := range resp.Events {
+		row := &datasource.TableRow{}
+		timestamp := time.Unix(*e.Timestamp/1000, *e.Timestamp%1000*1000*1000).Format(time.RFC3339)
+		ingestionTime := time.Unix(*e.IngestionTime/1000, *e.IngestionTime%1000*1000*1000).Format(time.RFC3339)
+		row.Values = append(row.Values,
+			&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: timestamp},
+			&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: ingestionTime},
+			&datasource.RowValue{Kind: datasource.RowValue_TYPE_STRING, StringValue: *e.LogStreamName})
+		for _, name := range fieldOrder {
+			row.Values = append(row.Values, rowValueForScalar(parsedEvents[i][name]))
+		}
+		table.Rows = append(table.Rows, row)
+	}
+
+	return &datasource.QueryResult{
+		RefId:  refId,
+		Tables: []*datasource.Table{table},
+	}, nil
+}
+
+// parseTimeSeriesResponse turns parsed Message fields into a time series,
+// the same way handleInsightsQuery does for Insights results: TimestampColumn
+// and ValueColumn pick the time/value fields and every other field becomes a
+// tag used for legend formatting and series grouping.
+func parseTimeSeriesResponse(resp *cloudwatchlogs.FilterLogEventsOutput, target Target) (*datasource.QueryResult, error) {
+	series := make(map[string]*datasource.TimeSeries)
+
+	for _, e := range resp.Events {
+		fields, err := parseMessage(target.MessageParser, *e.Message)
+		if err != nil {
+			return nil, err
+		}
+
+		value, ok := toFloat64(fields[target.ValueColumn])
+		if !ok {
+			continue
+		}
+
+		timestamp := *e.Timestamp
+		if target.TimestampColumn != "" {
+			if ts, ok := toFloat64(fields[target.TimestampColumn]); ok {
+				timestamp = int64(ts)
+			}
+		}
+
+		kv := make(map[string]string, len(fields))
+		for k, v := range fields {
+			if k == target.ValueColumn || k == target.TimestampColumn {
+				continue
+			}
+			kv[k] = fmt.Sprintf("%v", v)
+		}
+
+		name := formatLegend(kv, target.LegendFormat)
+		if series[name] == nil {
+			series[name] = &datasource.TimeSeries{Name: name, Tags: kv}
+		}
+		series[name].Points = append(series[name].Points, &datasource.Point{Timestamp: timestamp, Value: value})
+	}
+
+	s := make([]*datasource.TimeSeries, 0, len(series))
+	for _, ss := range series {
+		s = append(s, ss)
+	}
+
+	return &datasource.QueryResult{RefId: target.RefId, Series: s}, nil
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch vv := v.(type) {
+	case float64:
+		return vv, true
+	case string:
+		f, err := strconv.ParseFloat(vv, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}